@@ -0,0 +1,300 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/expression/builtin"
+)
+
+const (
+	// ExprEvalAggregatesKey is the key saving the slice of precomputed
+	// aggregate function values in the eval environment. AggregateRef reads
+	// its value from the Index-th slot of this slice.
+	ExprEvalAggregatesKey = "$aggregates"
+)
+
+var errNestedAggregate = errors.New("aggregate functions cannot be nested")
+
+// AggregateRef is a placeholder expression produced by ExtractAggregates.
+// It stands in for an aggregate function call that the aggregation
+// executor has already computed once per group; evaluating it simply reads
+// the precomputed value back out of env[ExprEvalAggregatesKey] instead of
+// re-running the aggregate.
+type AggregateRef struct {
+	// Index is this aggregate's position in the aggregates slice returned
+	// by ExtractAggregates.
+	Index int
+}
+
+// Clone implements the Expression Clone interface.
+func (r *AggregateRef) Clone() Expression {
+	return &AggregateRef{Index: r.Index}
+}
+
+// IsStatic implements the Expression IsStatic interface.
+func (r *AggregateRef) IsStatic() bool {
+	return false
+}
+
+// String implements the Expression String interface.
+func (r *AggregateRef) String() string {
+	return fmt.Sprintf("$aggregates[%d]", r.Index)
+}
+
+// Eval implements the Expression Eval interface.
+func (r *AggregateRef) Eval(ctx context.Context, env map[interface{}]interface{}) (interface{}, error) {
+	v, ok := env[ExprEvalAggregatesKey]
+	if !ok {
+		return nil, errors.Errorf("no precomputed aggregates in eval environment for %s", r)
+	}
+
+	values, ok := v.([]interface{})
+	if !ok || r.Index >= len(values) {
+		return nil, errors.Errorf("aggregate index %d out of range", r.Index)
+	}
+
+	return values[r.Index], nil
+}
+
+// Accept implements the Expression Accept interface. AggregateRef is a
+// synthetic node that only ever appears after ExtractAggregates has already
+// rewritten a tree, i.e. after any visitor walking original query syntax
+// would run, so it has nothing to recurse into and returns itself.
+func (r *AggregateRef) Accept(v Visitor) (Expression, error) {
+	return r, nil
+}
+
+// aggregateExtractor walks an expression tree exactly once, pulling every
+// aggregate function call out into aggregates and leaving an AggregateRef
+// in its place, so the rewritten tree can be evaluated once per group by a
+// real two-phase (streaming or hash) aggregation executor instead of
+// re-evaluating every aggregate from scratch for each row.
+type aggregateExtractor struct {
+	aggregates  []*Call
+	inAggregate bool
+	err         error
+}
+
+// addAggregate appends call to ex.aggregates, unless an equal call is
+// already present, in which case the existing slot is reused. This lets
+// ExtractAggregates be seeded with another pass's aggregates (see
+// ExtractAggregatesWithSeed) so e.g. a HAVING clause referencing the same
+// aggregate as the SELECT list gets the SELECT list's slot instead of
+// having it computed a second time.
+func (ex *aggregateExtractor) addAggregate(call *Call) *AggregateRef {
+	key := call.String()
+	for i, existing := range ex.aggregates {
+		if existing.String() == key {
+			return &AggregateRef{Index: i}
+		}
+	}
+
+	ex.aggregates = append(ex.aggregates, call)
+	return &AggregateRef{Index: len(ex.aggregates) - 1}
+}
+
+func (ex *aggregateExtractor) extract(e Expression) Expression {
+	if ex.err != nil {
+		return e
+	}
+
+	switch x := e.(type) {
+	case Value, *Value, *Variable, *Default,
+		*Ident, SubQuery, *Position, *ExistsSubQuery:
+		return e
+	case *Call:
+		f, ok := builtin.Funcs[strings.ToLower(x.F)]
+		if !ok {
+			ex.err = errors.Errorf("unknown function %s", x.F)
+			return e
+		}
+
+		if f.IsAggregate {
+			if ex.inAggregate {
+				ex.err = errors.Trace(errNestedAggregate)
+				return e
+			}
+
+			ex.inAggregate = true
+			for _, arg := range x.Args {
+				ex.extract(arg)
+				if ex.err != nil {
+					return e
+				}
+			}
+			ex.inAggregate = false
+
+			return ex.addAggregate(x.Clone().(*Call))
+		}
+
+		y := x.Clone().(*Call)
+		y.Args = make([]Expression, len(x.Args))
+		for i, arg := range x.Args {
+			y.Args[i] = ex.extract(arg)
+		}
+		return y
+	case *IsNull:
+		y := x.Clone().(*IsNull)
+		y.Expr = ex.extract(x.Expr)
+		return y
+	case *PExpr:
+		y := x.Clone().(*PExpr)
+		y.Expr = ex.extract(x.Expr)
+		return y
+	case *PatternIn:
+		y := x.Clone().(*PatternIn)
+		y.Expr = ex.extract(x.Expr)
+		y.List = make([]Expression, len(x.List))
+		for i, e := range x.List {
+			y.List[i] = ex.extract(e)
+		}
+		return y
+	case *PatternLike:
+		y := x.Clone().(*PatternLike)
+		y.Expr = ex.extract(x.Expr)
+		y.Pattern = ex.extract(x.Pattern)
+		return y
+	case *UnaryOperation:
+		y := x.Clone().(*UnaryOperation)
+		y.V = ex.extract(x.V)
+		return y
+	case *ParamMarker:
+		y := x.Clone().(*ParamMarker)
+		if x.Expr != nil {
+			y.Expr = ex.extract(x.Expr)
+		}
+		return y
+	case *FunctionCast:
+		y := x.Clone().(*FunctionCast)
+		if x.Expr != nil {
+			y.Expr = ex.extract(x.Expr)
+		}
+		return y
+	case *FunctionConvert:
+		y := x.Clone().(*FunctionConvert)
+		if x.Expr != nil {
+			y.Expr = ex.extract(x.Expr)
+		}
+		return y
+	case *FunctionSubstring:
+		y := x.Clone().(*FunctionSubstring)
+		if x.StrExpr != nil {
+			y.StrExpr = ex.extract(x.StrExpr)
+		}
+		if x.Pos != nil {
+			y.Pos = ex.extract(x.Pos)
+		}
+		if x.Len != nil {
+			y.Len = ex.extract(x.Len)
+		}
+		return y
+	case *FunctionCase:
+		y := x.Clone().(*FunctionCase)
+		if x.Value != nil {
+			y.Value = ex.extract(x.Value)
+		}
+		y.WhenClauses = make([]*WhenClause, len(x.WhenClauses))
+		for i, w := range x.WhenClauses {
+			y.WhenClauses[i] = ex.extract(w).(*WhenClause)
+		}
+		if x.ElseClause != nil {
+			y.ElseClause = ex.extract(x.ElseClause)
+		}
+		return y
+	case *WhenClause:
+		y := x.Clone().(*WhenClause)
+		y.Expr = ex.extract(x.Expr)
+		y.Result = ex.extract(x.Result)
+		return y
+	case *IsTruth:
+		y := x.Clone().(*IsTruth)
+		y.Expr = ex.extract(x.Expr)
+		return y
+	case *Between:
+		y := x.Clone().(*Between)
+		y.Expr = ex.extract(x.Expr)
+		y.Left = ex.extract(x.Left)
+		y.Right = ex.extract(x.Right)
+		return y
+	case *Row:
+		y := x.Clone().(*Row)
+		y.Values = make([]Expression, len(x.Values))
+		for i, v := range x.Values {
+			y.Values[i] = ex.extract(v)
+		}
+		return y
+	case *CompareSubQuery:
+		y := x.Clone().(*CompareSubQuery)
+		y.L = ex.extract(x.L)
+		return y
+	case *BinaryOperation:
+		y := x.Clone().(*BinaryOperation)
+		y.L = ex.extract(x.L)
+		y.R = ex.extract(x.R)
+		return y
+	default:
+		ex.err = errors.Errorf("ExtractAggregates: unknown expression %T", e)
+		return e
+	}
+}
+
+// ExtractAggregates walks e once, extracting every aggregate function call
+// into aggregates and replacing it in the returned tree with an
+// AggregateRef pointing at its slot. The rewritten expression can then be
+// evaluated with env[ExprEvalAggregatesKey] set to the aggregates' computed
+// values, letting the executor run a real streaming/hash aggregate instead
+// of re-evaluating every aggregate from scratch for each output row.
+// Nested aggregates, e.g. SUM(MAX(c)), are rejected.
+func ExtractAggregates(e Expression) (rewritten Expression, aggregates []*Call, err error) {
+	return ExtractAggregatesWithSeed(e, nil)
+}
+
+// ExtractAggregatesWithSeed is ExtractAggregates, but the returned
+// aggregates slice starts from seed rather than empty: any aggregate call
+// in e equal to one already in seed reuses that slot instead of being
+// appended as a duplicate, so multiple clauses (e.g. a SELECT list and its
+// HAVING clause) that mention the same aggregate share a single computed
+// value.
+func ExtractAggregatesWithSeed(e Expression, seed []*Call) (rewritten Expression, aggregates []*Call, err error) {
+	ex := &aggregateExtractor{aggregates: append([]*Call{}, seed...)}
+	rewritten = ex.extract(e)
+	if ex.err != nil {
+		return nil, nil, errors.Trace(ex.err)
+	}
+
+	return rewritten, ex.aggregates, nil
+}
+
+// ContainsAggregate reports whether e contains an aggregate function call.
+// It is a thin, read-only wrapper around MentionedAggregateFuncs, kept here
+// as the ExtractAggregates-era name for the same check ContainAggregateFunc
+// already performs.
+func ContainsAggregate(e Expression) bool {
+	return ContainAggregateFunc(e)
+}
+
+// SplitHavingIntoPreAndPost lowers a HAVING clause so it can be applied
+// after aggregation. selectAggregates is the aggregates slice already
+// extracted from the SELECT list, e.g. via ExtractAggregates; any aggregate
+// call in having equal to one selectAggregates already computed reuses
+// that same slot instead of being computed a second time, and only a
+// genuinely new HAVING-only aggregate grows aggregates past
+// len(selectAggregates). The returned post expression has every aggregate
+// call in having replaced with an AggregateRef into aggregates. For
+// example, SELECT count(*) ... HAVING count(*) > 1 lowers to post =
+// $aggregates[0] > 1, reusing the SELECT list's count(*) slot.
+func SplitHavingIntoPreAndPost(having Expression, selectAggregates []*Call) (post Expression, aggregates []*Call, err error) {
+	post, aggregates, err = ExtractAggregatesWithSeed(having, selectAggregates)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return post, aggregates, nil
+}
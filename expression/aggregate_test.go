@@ -0,0 +1,113 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	"testing"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/parser/opcode"
+)
+
+func TestT(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&testAggregateSuite{})
+
+type testAggregateSuite struct{}
+
+func (s *testAggregateSuite) TestExtractAggregatesRewritesCallToRef(c *C) {
+	call := &Call{F: "count", Args: []Expression{&Ident{model.NewCIStr("c")}}}
+
+	rewritten, aggregates, err := ExtractAggregates(call)
+	c.Assert(err, IsNil)
+	c.Assert(aggregates, HasLen, 1)
+
+	ref, ok := rewritten.(*AggregateRef)
+	c.Assert(ok, IsTrue)
+	c.Assert(ref.Index, Equals, 0)
+}
+
+func (s *testAggregateSuite) TestExtractAggregatesLeavesPlainExprAlone(c *C) {
+	ident := &Ident{model.NewCIStr("c")}
+
+	rewritten, aggregates, err := ExtractAggregates(ident)
+	c.Assert(err, IsNil)
+	c.Assert(aggregates, HasLen, 0)
+	c.Assert(rewritten, Equals, Expression(ident))
+}
+
+func (s *testAggregateSuite) TestExtractAggregatesRejectsNested(c *C) {
+	inner := &Call{F: "max", Args: []Expression{&Ident{model.NewCIStr("c")}}}
+	outer := &Call{F: "sum", Args: []Expression{inner}}
+
+	_, _, err := ExtractAggregates(outer)
+	c.Assert(err, NotNil)
+}
+
+func (s *testAggregateSuite) TestContainsAggregate(c *C) {
+	call := &Call{F: "count", Args: []Expression{&Ident{model.NewCIStr("c")}}}
+	c.Assert(ContainsAggregate(call), IsTrue)
+	c.Assert(ContainsAggregate(&Ident{model.NewCIStr("c")}), IsFalse)
+}
+
+func (s *testAggregateSuite) TestAggregateRefEval(c *C) {
+	ref := &AggregateRef{Index: 1}
+	env := map[interface{}]interface{}{
+		ExprEvalAggregatesKey: []interface{}{int64(1), int64(2)},
+	}
+
+	v, err := ref.Eval(nil, env)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, int64(2))
+}
+
+func (s *testAggregateSuite) TestAggregateRefEvalMissingEnv(c *C) {
+	ref := &AggregateRef{Index: 0}
+	_, err := ref.Eval(nil, map[interface{}]interface{}{})
+	c.Assert(err, NotNil)
+}
+
+func (s *testAggregateSuite) TestSplitHavingIntoPreAndPost(c *C) {
+	having := &BinaryOperation{
+		Op: opcode.GT,
+		L:  &Call{F: "sum", Args: []Expression{&Ident{model.NewCIStr("c")}}},
+		R:  Value{int64(1)},
+	}
+
+	post, aggregates, err := SplitHavingIntoPreAndPost(having, nil)
+	c.Assert(err, IsNil)
+	c.Assert(aggregates, HasLen, 1)
+
+	bin, ok := post.(*BinaryOperation)
+	c.Assert(ok, IsTrue)
+	_, ok = bin.L.(*AggregateRef)
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testAggregateSuite) TestSplitHavingIntoPreAndPostReusesSelectSlot(c *C) {
+	countStar := &Call{F: "count", Args: []Expression{&Ident{model.NewCIStr("*")}}}
+	selectAggregates := []*Call{countStar}
+
+	having := &BinaryOperation{
+		Op: opcode.GT,
+		L:  countStar.Clone().(*Call),
+		R:  Value{int64(1)},
+	}
+
+	post, aggregates, err := SplitHavingIntoPreAndPost(having, selectAggregates)
+	c.Assert(err, IsNil)
+	// having's count(*) is equal to the SELECT list's, so no new slot is
+	// allocated for it.
+	c.Assert(aggregates, HasLen, 1)
+
+	bin, ok := post.(*BinaryOperation)
+	c.Assert(ok, IsTrue)
+	ref, ok := bin.L.(*AggregateRef)
+	c.Assert(ok, IsTrue)
+	c.Assert(ref.Index, Equals, 0)
+}
@@ -42,6 +42,11 @@ const (
 	// ExprEvalDefaultName is the key saving default column name for Default expression.
 	ExprEvalDefaultName = "$defaultName"
 	// ExprEvalIdentFunc is the key saving a function to retrieve value for identifier name.
+	//
+	// TODO: once a caller resolves its query's *Ident nodes with
+	// ResolveNames, it should populate ExprEvalRowKey instead of this entry
+	// and drop $identFunc for that code path; this env key, and its
+	// *Position/VALUES() counterparts below, have not been migrated yet.
 	ExprEvalIdentFunc = "$identFunc"
 	// ExprEvalPositionFunc is the key saving a Position expresion.
 	ExprEvalPositionFunc = "$positionFunc"
@@ -85,7 +90,9 @@ func cloneExpressionList(list []Expression) []Expression {
 	return r
 }
 
-// FastEval evaluates Value and static +/- Unary expression and returns its value.
+// FastEval evaluates Value and static +/- Unary expression and returns its
+// value. Callers that run expressions through TypeCheck get this folding
+// for free, for any static subtree, and should prefer that path.
 func FastEval(v interface{}) interface{} {
 	switch x := v.(type) {
 	case Value:
@@ -226,7 +233,12 @@ func ContainAggregateFunc(e Expression) bool {
 	return len(m) > 0
 }
 
-// MentionedColumns returns a list of names for Ident expression.
+// MentionedColumns returns a list of names for Ident expression. It only
+// understands the legacy *Ident form; MentionedColumnIndices is the
+// IndexedVar-based counterpart for expressions that have already been
+// through ResolveNames, but no caller has been switched over to it yet
+// (tracked as follow-up work alongside the ExprEvalIdentFunc migration
+// above).
 func MentionedColumns(e Expression) []string {
 	var names []string
 	mcv := &MentionedColumnsVisitor{
@@ -239,6 +251,8 @@ func MentionedColumns(e Expression) []string {
 	return names
 }
 
+// staticExpr constant-folds e if it is static. TypeCheck performs the same
+// folding as part of its single pass and is preferred for new callers.
 func staticExpr(e Expression) (Expression, error) {
 	if e.IsStatic() {
 		v, err := e.Eval(nil, nil)
@@ -346,6 +360,10 @@ func getTimeValue(ctx context.Context, v interface{}, tp byte, fsp int) (interfa
 		return nil, errors.Trace(errDefaultValue)
 	case *UnaryOperation:
 		// support some expression, like `-1`
+		if err := SanitizeVarFreeExpr(x, nil, "default value for time column"); err != nil {
+			return nil, errors.Trace(err)
+		}
+
 		m := map[interface{}]interface{}{}
 		v := Eval(x, nil, m)
 		ft := types.NewFieldType(mysql.TypeLonglong)
@@ -365,7 +383,12 @@ func getTimeValue(ctx context.Context, v interface{}, tp byte, fsp int) (interfa
 	return value, nil
 }
 
-// EvalBoolExpr evaluates an expression and convert its return value to bool.
+// EvalBoolExpr evaluates an expression and convert its return value to
+// bool, against an env built however the caller's expression tree needs it
+// — a legacy map keyed by identifier name, or an env carrying
+// ExprEvalRowKey for an expression already resolved by ResolveNames.
+// EvalBoolExprResolved is a convenience wrapper for that latter case; no
+// caller has been switched over to producing a resolved tree yet.
 func EvalBoolExpr(ctx context.Context, expr Expression, m map[interface{}]interface{}) (bool, error) {
 	val, err := expr.Eval(ctx, m)
 	if err != nil {
@@ -0,0 +1,473 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/util/types"
+)
+
+const (
+	// ExprEvalRowKey is the key saving the current row, as a slice indexed
+	// by column ordinal, in the eval environment. IndexedVar reads its
+	// value from the Idx-th slot of this slice in O(1), instead of walking
+	// env as a map[interface{}]interface{} keyed by column name.
+	ExprEvalRowKey = "$row"
+)
+
+// IndexedVar is a placeholder expression produced by ResolveNames. It
+// stands in for a column reference that has already been resolved to its
+// ordinal within the assembled row, so Eval can read it directly out of
+// env[ExprEvalRowKey] instead of looking the name up by key on every row.
+type IndexedVar struct {
+	Idx int
+	Typ *types.FieldType
+}
+
+// Clone implements the Expression Clone interface.
+func (v *IndexedVar) Clone() Expression {
+	return &IndexedVar{Idx: v.Idx, Typ: v.Typ}
+}
+
+// IsStatic implements the Expression IsStatic interface.
+func (v *IndexedVar) IsStatic() bool {
+	return false
+}
+
+// String implements the Expression String interface.
+func (v *IndexedVar) String() string {
+	return fmt.Sprintf("$row[%d]", v.Idx)
+}
+
+// Eval implements the Expression Eval interface.
+func (v *IndexedVar) Eval(ctx context.Context, env map[interface{}]interface{}) (interface{}, error) {
+	r, ok := env[ExprEvalRowKey]
+	if !ok {
+		return nil, errors.Errorf("no row in eval environment for %s", v)
+	}
+
+	row, ok := r.([]interface{})
+	if !ok || v.Idx >= len(row) {
+		return nil, errors.Errorf("column index %d out of range", v.Idx)
+	}
+
+	return row[v.Idx], nil
+}
+
+// Accept implements the Expression Accept interface. IndexedVar is a
+// synthetic node that only ever appears after ResolveNames has already
+// rewritten a tree, i.e. after any visitor walking original query syntax
+// would run, so it has nothing to recurse into and returns itself. This
+// mirrors how AggregateRef.Accept (expression/aggregate.go) handles the
+// same situation for the other synthetic leaf this series adds.
+func (v *IndexedVar) Accept(vis Visitor) (Expression, error) {
+	return v, nil
+}
+
+// columnInfo describes one column produced by a FROM source.
+type columnInfo struct {
+	tableAlias string
+	columnName string
+	tp         *types.FieldType
+}
+
+// DataSourceInfo holds the ordered list of columns produced by every source
+// in a query's FROM clause (base tables, derived tables, joins), in the
+// order the planner assembles the row. ResolveNames resolves names against
+// it, and ORDER BY/GROUP BY ordinals index into it directly.
+type DataSourceInfo struct {
+	columns []columnInfo
+}
+
+// NewDataSourceInfo creates an empty DataSourceInfo.
+func NewDataSourceInfo() *DataSourceInfo {
+	return &DataSourceInfo{}
+}
+
+// AddColumn appends a column produced by tableAlias to the source list. The
+// order columns are added in becomes their row ordinal.
+func (d *DataSourceInfo) AddColumn(tableAlias, columnName string, tp *types.FieldType) {
+	d.columns = append(d.columns, columnInfo{tableAlias, columnName, tp})
+}
+
+// Len returns how many columns are currently registered, i.e. the number of
+// slots available for ordinal (ORDER BY/GROUP BY position) resolution.
+func (d *DataSourceInfo) Len() int {
+	return len(d.columns)
+}
+
+// find resolves name, optionally qualified as alias.column, to a row
+// ordinal, following MySQL's rules: a qualified name must match its alias
+// (compared case-insensitively), an unqualified name must be unique across
+// every source.
+func (d *DataSourceInfo) find(alias, name string) (int, error) {
+	found := -1
+	for i, c := range d.columns {
+		if !strings.EqualFold(c.columnName, name) {
+			continue
+		}
+		if alias != "" && !strings.EqualFold(c.tableAlias, alias) {
+			continue
+		}
+		if found != -1 {
+			return -1, errors.Errorf("Column '%s' in field list is ambiguous", name)
+		}
+		found = i
+	}
+
+	if found == -1 {
+		if alias != "" {
+			return -1, errors.Errorf("Unknown column '%s.%s'", alias, name)
+		}
+		return -1, errors.Errorf("Unknown column '%s'", name)
+	}
+
+	return found, nil
+}
+
+// IndexedVarHelper records which column ordinals ResolveNames references,
+// so the executor can prune the physical row down to just the columns a
+// query needs instead of materializing every source column. It allocates
+// no separate slots: each IndexedVar's Idx is the column's ordinal in the
+// helper's DataSourceInfo.
+type IndexedVarHelper struct {
+	sources *DataSourceInfo
+	used    map[int]bool
+}
+
+// NewIndexedVarHelper creates a helper resolving names against sources.
+func NewIndexedVarHelper(sources *DataSourceInfo) *IndexedVarHelper {
+	return &IndexedVarHelper{sources: sources, used: map[int]bool{}}
+}
+
+// Needed returns, in ascending order, every ordinal referenced since the
+// helper was created.
+func (h *IndexedVarHelper) Needed() []int {
+	needed := make([]int, 0, len(h.used))
+	for idx := range h.used {
+		needed = append(needed, idx)
+	}
+	sort.Ints(needed)
+	return needed
+}
+
+func (h *IndexedVarHelper) resolve(alias, name string) (*IndexedVar, error) {
+	idx, err := h.sources.find(alias, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	h.used[idx] = true
+	return &IndexedVar{Idx: idx, Typ: h.sources.columns[idx].tp}, nil
+}
+
+func (h *IndexedVarHelper) resolveOrdinal(pos int64) (*IndexedVar, error) {
+	idx := int(pos) - 1
+	if idx < 0 || idx >= h.sources.Len() {
+		return nil, errors.Errorf("Unknown column '%d' in 'order clause'", pos)
+	}
+
+	h.used[idx] = true
+	return &IndexedVar{Idx: idx, Typ: h.sources.columns[idx].tp}, nil
+}
+
+// splitQualifiedName splits a possibly-qualified identifier such as "t.c"
+// into its table alias and column name, mirroring IsQualified.
+func splitQualifiedName(name string) (alias, column string) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// nameResolver walks an expression tree exactly once, replacing every
+// *Ident with the IndexedVar its referenced column resolves to.
+type nameResolver struct {
+	helper *IndexedVarHelper
+	err    error
+}
+
+func (r *nameResolver) resolve(e Expression) Expression {
+	if r.err != nil {
+		return e
+	}
+
+	switch x := e.(type) {
+	case Value, *Value, *Variable, *Default,
+		*Position, SubQuery, *ExistsSubQuery:
+		return e
+	case *Ident:
+		alias, name := splitQualifiedName(x.O)
+		iv, err := r.helper.resolve(alias, name)
+		if err != nil {
+			r.err = errors.Trace(err)
+			return e
+		}
+		return iv
+	case *Call:
+		y := x.Clone().(*Call)
+		y.Args = make([]Expression, len(x.Args))
+		for i, arg := range x.Args {
+			y.Args[i] = r.resolve(arg)
+		}
+		return y
+	case *BinaryOperation:
+		y := x.Clone().(*BinaryOperation)
+		y.L = r.resolve(x.L)
+		y.R = r.resolve(x.R)
+		return y
+	case *IsNull:
+		y := x.Clone().(*IsNull)
+		y.Expr = r.resolve(x.Expr)
+		return y
+	case *PExpr:
+		y := x.Clone().(*PExpr)
+		y.Expr = r.resolve(x.Expr)
+		return y
+	case *PatternIn:
+		y := x.Clone().(*PatternIn)
+		y.Expr = r.resolve(x.Expr)
+		y.List = make([]Expression, len(x.List))
+		for i, e := range x.List {
+			y.List[i] = r.resolve(e)
+		}
+		return y
+	case *PatternLike:
+		y := x.Clone().(*PatternLike)
+		y.Expr = r.resolve(x.Expr)
+		y.Pattern = r.resolve(x.Pattern)
+		return y
+	case *UnaryOperation:
+		y := x.Clone().(*UnaryOperation)
+		y.V = r.resolve(x.V)
+		return y
+	case *ParamMarker:
+		y := x.Clone().(*ParamMarker)
+		if x.Expr != nil {
+			y.Expr = r.resolve(x.Expr)
+		}
+		return y
+	case *FunctionCast:
+		y := x.Clone().(*FunctionCast)
+		if x.Expr != nil {
+			y.Expr = r.resolve(x.Expr)
+		}
+		return y
+	case *FunctionConvert:
+		y := x.Clone().(*FunctionConvert)
+		if x.Expr != nil {
+			y.Expr = r.resolve(x.Expr)
+		}
+		return y
+	case *FunctionSubstring:
+		y := x.Clone().(*FunctionSubstring)
+		if x.StrExpr != nil {
+			y.StrExpr = r.resolve(x.StrExpr)
+		}
+		if x.Pos != nil {
+			y.Pos = r.resolve(x.Pos)
+		}
+		if x.Len != nil {
+			y.Len = r.resolve(x.Len)
+		}
+		return y
+	case *FunctionCase:
+		y := x.Clone().(*FunctionCase)
+		if x.Value != nil {
+			y.Value = r.resolve(x.Value)
+		}
+		y.WhenClauses = make([]*WhenClause, len(x.WhenClauses))
+		for i, w := range x.WhenClauses {
+			y.WhenClauses[i] = r.resolve(w).(*WhenClause)
+		}
+		if x.ElseClause != nil {
+			y.ElseClause = r.resolve(x.ElseClause)
+		}
+		return y
+	case *WhenClause:
+		y := x.Clone().(*WhenClause)
+		y.Expr = r.resolve(x.Expr)
+		y.Result = r.resolve(x.Result)
+		return y
+	case *IsTruth:
+		y := x.Clone().(*IsTruth)
+		y.Expr = r.resolve(x.Expr)
+		return y
+	case *Between:
+		y := x.Clone().(*Between)
+		y.Expr = r.resolve(x.Expr)
+		y.Left = r.resolve(x.Left)
+		y.Right = r.resolve(x.Right)
+		return y
+	case *Row:
+		y := x.Clone().(*Row)
+		y.Values = make([]Expression, len(x.Values))
+		for i, v := range x.Values {
+			y.Values[i] = r.resolve(v)
+		}
+		return y
+	case *CompareSubQuery:
+		y := x.Clone().(*CompareSubQuery)
+		y.L = r.resolve(x.L)
+		return y
+	default:
+		r.err = errors.Errorf("ResolveNames: unknown expression %T", e)
+		return e
+	}
+}
+
+// ResolveNames walks e once, resolving every column reference against the
+// DataSourceInfo helper was created with (sources is not consulted
+// separately) and replacing it with an IndexedVar carrying its row ordinal,
+// so the executor can read column values out of a positional row slice in
+// O(1) instead of re-resolving names through env as a map on every row.
+// Qualified names (t.c) are resolved against the alias; an unqualified name
+// must be unique across sources or resolution fails with an "ambiguous
+// column" error. needed lists, in ascending order, every ordinal helper has
+// recorded, including those from earlier calls with the same helper, so
+// the executor can prune the row down to just the columns it needs.
+func ResolveNames(e Expression, sources *DataSourceInfo, helper *IndexedVarHelper) (rewritten Expression, needed []int, err error) {
+	r := &nameResolver{helper: helper}
+	rewritten = r.resolve(e)
+	if r.err != nil {
+		return nil, nil, errors.Trace(r.err)
+	}
+
+	return rewritten, helper.Needed(), nil
+}
+
+// ResolveOrderByNames resolves e as an ORDER BY or GROUP BY item: a bare
+// integer literal, or a *Position, is treated as a 1-based ordinal into the
+// helper's DataSourceInfo columns, in the order AddColumn registered them,
+// rather than a column reference, and collapsed to the same IndexedVar form
+// ResolveNames would produce for a real column. The ordinal is not mapped
+// through a SELECT list. Anything else is resolved exactly as ResolveNames
+// would.
+func ResolveOrderByNames(e Expression, sources *DataSourceInfo, helper *IndexedVarHelper) (rewritten Expression, needed []int, err error) {
+	switch x := e.(type) {
+	case Value:
+		if n, ok := x.Val.(int64); ok {
+			iv, err := helper.resolveOrdinal(n)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			return iv, helper.Needed(), nil
+		}
+	case *Position:
+		iv, err := helper.resolveOrdinal(int64(x.N))
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		return iv, helper.Needed(), nil
+	}
+
+	return ResolveNames(e, sources, helper)
+}
+
+// MentionedColumnIndices returns the set of row ordinals referenced by e,
+// for expressions that have already been through ResolveNames. It is the
+// IndexedVar-based counterpart of MentionedColumns, which only understands
+// the legacy *Ident/map-based form; callers that have migrated a code path
+// to the resolved form should prefer this.
+func MentionedColumnIndices(e Expression) []int {
+	m := map[int]struct{}{}
+	mentionedColumnIndices(e, m)
+
+	indices := make([]int, 0, len(m))
+	for idx := range m {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func mentionedColumnIndices(e Expression, m map[int]struct{}) {
+	switch x := e.(type) {
+	case *IndexedVar:
+		m[x.Idx] = struct{}{}
+	case *AggregateRef:
+		// nop: an AggregateRef carries no column reference, so the columns
+		// of the aggregate it stands for are not included.
+	case *BinaryOperation:
+		mentionedColumnIndices(x.L, m)
+		mentionedColumnIndices(x.R, m)
+	case *Call:
+		for _, arg := range x.Args {
+			mentionedColumnIndices(arg, m)
+		}
+	case *IsNull:
+		mentionedColumnIndices(x.Expr, m)
+	case *PExpr:
+		mentionedColumnIndices(x.Expr, m)
+	case *PatternIn:
+		mentionedColumnIndices(x.Expr, m)
+		for _, v := range x.List {
+			mentionedColumnIndices(v, m)
+		}
+	case *PatternLike:
+		mentionedColumnIndices(x.Expr, m)
+		mentionedColumnIndices(x.Pattern, m)
+	case *UnaryOperation:
+		mentionedColumnIndices(x.V, m)
+	case *IsTruth:
+		mentionedColumnIndices(x.Expr, m)
+	case *Between:
+		mentionedColumnIndices(x.Expr, m)
+		mentionedColumnIndices(x.Left, m)
+		mentionedColumnIndices(x.Right, m)
+	case *Row:
+		for _, v := range x.Values {
+			mentionedColumnIndices(v, m)
+		}
+	case *CompareSubQuery:
+		mentionedColumnIndices(x.L, m)
+	case *FunctionCast:
+		if x.Expr != nil {
+			mentionedColumnIndices(x.Expr, m)
+		}
+	case *FunctionConvert:
+		if x.Expr != nil {
+			mentionedColumnIndices(x.Expr, m)
+		}
+	case *FunctionSubstring:
+		if x.StrExpr != nil {
+			mentionedColumnIndices(x.StrExpr, m)
+		}
+		if x.Pos != nil {
+			mentionedColumnIndices(x.Pos, m)
+		}
+		if x.Len != nil {
+			mentionedColumnIndices(x.Len, m)
+		}
+	case *FunctionCase:
+		if x.Value != nil {
+			mentionedColumnIndices(x.Value, m)
+		}
+		for _, w := range x.WhenClauses {
+			mentionedColumnIndices(w, m)
+		}
+		if x.ElseClause != nil {
+			mentionedColumnIndices(x.ElseClause, m)
+		}
+	case *WhenClause:
+		mentionedColumnIndices(x.Expr, m)
+		mentionedColumnIndices(x.Result, m)
+	}
+}
+
+// EvalBoolExprResolved evaluates expr, which must already have gone through
+// ResolveNames, against row by placing it under ExprEvalRowKey. It is the
+// IndexedVar-based counterpart of EvalBoolExpr; callers that still hold
+// *Ident-based expressions, or that are not resolved against a single row,
+// should keep using the map-based EvalBoolExpr.
+func EvalBoolExprResolved(ctx context.Context, expr Expression, row []interface{}) (bool, error) {
+	env := map[interface{}]interface{}{ExprEvalRowKey: row}
+	return EvalBoolExpr(ctx, expr, env)
+}
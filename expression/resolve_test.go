@@ -0,0 +1,111 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	. "github.com/pingcap/check"
+	mysql "github.com/pingcap/tidb/mysqldef"
+
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/util/types"
+)
+
+var _ = Suite(&testResolveSuite{})
+
+type testResolveSuite struct{}
+
+func newTestDataSourceInfo() *DataSourceInfo {
+	sources := NewDataSourceInfo()
+	sources.AddColumn("t1", "a", types.NewFieldType(mysql.TypeLonglong))
+	sources.AddColumn("t1", "b", types.NewFieldType(mysql.TypeVarString))
+	sources.AddColumn("t2", "a", types.NewFieldType(mysql.TypeLonglong))
+	return sources
+}
+
+func (s *testResolveSuite) TestResolveNamesQualified(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	rewritten, needed, err := ResolveNames(&Ident{model.NewCIStr("t2.a")}, sources, helper)
+	c.Assert(err, IsNil)
+	c.Assert(needed, DeepEquals, []int{2})
+
+	iv, ok := rewritten.(*IndexedVar)
+	c.Assert(ok, IsTrue)
+	c.Assert(iv.Idx, Equals, 2)
+}
+
+func (s *testResolveSuite) TestResolveNamesUnqualified(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	rewritten, needed, err := ResolveNames(&Ident{model.NewCIStr("b")}, sources, helper)
+	c.Assert(err, IsNil)
+	c.Assert(needed, DeepEquals, []int{1})
+
+	iv, ok := rewritten.(*IndexedVar)
+	c.Assert(ok, IsTrue)
+	c.Assert(iv.Idx, Equals, 1)
+}
+
+func (s *testResolveSuite) TestResolveNamesAmbiguous(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	_, _, err := ResolveNames(&Ident{model.NewCIStr("a")}, sources, helper)
+	c.Assert(err, NotNil)
+}
+
+func (s *testResolveSuite) TestResolveNamesUnknownColumn(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	_, _, err := ResolveNames(&Ident{model.NewCIStr("nope")}, sources, helper)
+	c.Assert(err, NotNil)
+}
+
+func (s *testResolveSuite) TestResolveOrderByOrdinal(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	rewritten, needed, err := ResolveOrderByNames(Value{int64(2)}, sources, helper)
+	c.Assert(err, IsNil)
+	c.Assert(needed, DeepEquals, []int{1})
+
+	iv, ok := rewritten.(*IndexedVar)
+	c.Assert(ok, IsTrue)
+	c.Assert(iv.Idx, Equals, 1)
+}
+
+func (s *testResolveSuite) TestResolveOrderByOrdinalOutOfRange(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	_, _, err := ResolveOrderByNames(Value{int64(99)}, sources, helper)
+	c.Assert(err, NotNil)
+}
+
+func (s *testResolveSuite) TestIndexedVarEval(c *C) {
+	iv := &IndexedVar{Idx: 1}
+	env := map[interface{}]interface{}{ExprEvalRowKey: []interface{}{"x", "y"}}
+
+	v, err := iv.Eval(nil, env)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "y")
+}
+
+func (s *testResolveSuite) TestMentionedColumnIndices(c *C) {
+	sources := newTestDataSourceInfo()
+	helper := NewIndexedVarHelper(sources)
+
+	expr := &BinaryOperation{
+		L: &Ident{model.NewCIStr("t1.a")},
+		R: &Ident{model.NewCIStr("t2.a")},
+	}
+	resolved, _, err := ResolveNames(expr, sources, helper)
+	c.Assert(err, IsNil)
+
+	c.Assert(MentionedColumnIndices(resolved), DeepEquals, []int{0, 2})
+}
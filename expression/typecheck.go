@@ -0,0 +1,568 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/expression/builtin"
+	mysql "github.com/pingcap/tidb/mysqldef"
+	"github.com/pingcap/tidb/parser/opcode"
+	"github.com/pingcap/tidb/util/types"
+)
+
+// TypedExpression wraps an Expression together with the FieldType that
+// TypeCheck resolved for it, so an executor that has already type checked a
+// query does not need to re-derive types, or re-run coercions, for every
+// row it evaluates.
+type TypedExpression interface {
+	Expression
+	// ResolvedType returns the FieldType TypeCheck resolved for this
+	// expression.
+	ResolvedType() *types.FieldType
+}
+
+type typedExpression struct {
+	Expression
+	tp *types.FieldType
+}
+
+func (te *typedExpression) ResolvedType() *types.FieldType {
+	return te.tp
+}
+
+func newTypedExpression(e Expression, tp *types.FieldType) TypedExpression {
+	return &typedExpression{Expression: e, tp: tp}
+}
+
+// typeChecker resolves the FieldType of every sub-expression in a single
+// pass, unifying child types using MySQL's implicit promotion rules,
+// verifying built-in function arity, and constant-folding static subtrees
+// down to a Value so later Eval calls can skip them entirely. Only the
+// root's type is kept, in the returned TypedExpression.
+type typeChecker struct {
+	ctx context.Context
+}
+
+// TypeCheck resolves and validates the type of e, returning a
+// TypedExpression that caches the result. desired is the FieldType the
+// caller expects e to produce, e.g. the target column's type for an INSERT
+// value; it may be nil when no particular type is expected. A NULL literal
+// resolves to desired rather than TypeNull, so later comparisons and
+// conversions do not have to special-case it.
+func TypeCheck(ctx context.Context, e Expression, desired *types.FieldType) (TypedExpression, error) {
+	tc := &typeChecker{ctx: ctx}
+	rewritten, tp, err := tc.check(e, desired)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newTypedExpression(rewritten, tp), nil
+}
+
+func (tc *typeChecker) check(e Expression, desired *types.FieldType) (Expression, *types.FieldType, error) {
+	var tp *types.FieldType
+
+	switch x := e.(type) {
+	case Value:
+		tp = typeOfValue(x.Val, desired)
+	case *Ident, *Variable, *Default, *Position, SubQuery, *ExistsSubQuery, *ParamMarker:
+		// The types of these depend on schema or session state that is not
+		// available in a context-free pass; they resolve to desired, or to
+		// VarString when desired is nil. Column references whose type is
+		// known come in as IndexedVar after ResolveNames instead.
+		tp = desired
+	case *IndexedVar:
+		// ResolveNames already resolved this column's type against its
+		// DataSourceInfo; reuse it instead of guessing from desired.
+		tp = x.Typ
+	case *AggregateRef:
+		// ExtractAggregates elides the original Call's signature; the
+		// aggregate's type is whatever the caller expects it to produce.
+		tp = desired
+	case *BinaryOperation:
+		l, lt, err := tc.check(x.L, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		r, rt, err := tc.check(x.R, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*BinaryOperation)
+		y.L, y.R = l, r
+		e = y
+		if isComparisonOrLogicalOp(x.Op) {
+			tp = types.NewFieldType(mysql.TypeLonglong)
+		} else {
+			tp = unifyType(lt, rt)
+		}
+	case *UnaryOperation:
+		v, vt, err := tc.check(x.V, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*UnaryOperation)
+		y.V = v
+		e = y
+		tp = vt
+	case *IsNull:
+		inner, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*IsNull)
+		y.Expr = inner
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *IsTruth:
+		inner, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*IsTruth)
+		y.Expr = inner
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *PatternIn:
+		inner, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*PatternIn)
+		y.Expr = inner
+		y.List = make([]Expression, len(x.List))
+		for i, v := range x.List {
+			rv, _, err := tc.check(v, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.List[i] = rv
+		}
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *PatternLike:
+		inner, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		pattern, _, err := tc.check(x.Pattern, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*PatternLike)
+		y.Expr, y.Pattern = inner, pattern
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *Between:
+		expr, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		left, _, err := tc.check(x.Left, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		right, _, err := tc.check(x.Right, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*Between)
+		y.Expr, y.Left, y.Right = expr, left, right
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *CompareSubQuery:
+		l, _, err := tc.check(x.L, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*CompareSubQuery)
+		y.L = l
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *PExpr:
+		inner, et, err := tc.check(x.Expr, desired)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*PExpr)
+		y.Expr = inner
+		e = y
+		tp = et
+	case *Row:
+		y := x.Clone().(*Row)
+		y.Values = make([]Expression, len(x.Values))
+		for i, v := range x.Values {
+			rv, _, err := tc.check(v, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Values[i] = rv
+		}
+		e = y
+		tp = types.NewFieldType(mysql.TypeLonglong)
+	case *FunctionCast:
+		y := x.Clone().(*FunctionCast)
+		if x.Expr != nil {
+			inner, _, err := tc.check(x.Expr, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Expr = inner
+		}
+		e = y
+		tp = x.Tp
+	case *FunctionConvert:
+		y := x.Clone().(*FunctionConvert)
+		if x.Expr != nil {
+			inner, _, err := tc.check(x.Expr, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Expr = inner
+		}
+		e = y
+		tp = x.Tp
+	case *FunctionSubstring:
+		y := x.Clone().(*FunctionSubstring)
+		if x.StrExpr != nil {
+			strExpr, _, err := tc.check(x.StrExpr, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.StrExpr = strExpr
+		}
+		if x.Pos != nil {
+			pos, _, err := tc.check(x.Pos, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Pos = pos
+		}
+		if x.Len != nil {
+			l, _, err := tc.check(x.Len, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Len = l
+		}
+		e = y
+		tp = types.NewFieldType(mysql.TypeVarString)
+	case *FunctionCase:
+		y := x.Clone().(*FunctionCase)
+		var branchType *types.FieldType
+		if x.Value != nil {
+			v, _, err := tc.check(x.Value, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Value = v
+		}
+		y.WhenClauses = make([]*WhenClause, len(x.WhenClauses))
+		for i, w := range x.WhenClauses {
+			rw, rt, err := tc.check(w, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.WhenClauses[i] = rw.(*WhenClause)
+			branchType = unifyType(branchType, rt)
+		}
+		if x.ElseClause != nil {
+			ec, et, err := tc.check(x.ElseClause, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.ElseClause = ec
+			branchType = unifyType(branchType, et)
+		}
+		e = y
+		tp = branchType
+	case *WhenClause:
+		expr, _, err := tc.check(x.Expr, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		result, rt, err := tc.check(x.Result, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		y := x.Clone().(*WhenClause)
+		y.Expr, y.Result = expr, result
+		e = y
+		tp = rt
+	case *Call:
+		f, ok := builtin.Funcs[strings.ToLower(x.F)]
+		if !ok {
+			return nil, nil, errors.Errorf("unknown function %s", x.F)
+		}
+		if len(x.Args) < f.MinArgs || (f.MaxArgs != -1 && len(x.Args) > f.MaxArgs) {
+			return nil, nil, errors.Errorf("Incorrect parameter count in the call to native function '%s'", x.F)
+		}
+		y := x.Clone().(*Call)
+		y.Args = make([]Expression, len(x.Args))
+		for i, arg := range x.Args {
+			ra, _, err := tc.check(arg, nil)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			y.Args[i] = ra
+		}
+		e = y
+		tp = desired
+	default:
+		return nil, nil, errors.Errorf("TypeCheck: unknown expression %T", e)
+	}
+
+	if tp == nil {
+		tp = desired
+	}
+	if tp == nil {
+		tp = types.NewFieldType(mysql.TypeVarString)
+	}
+
+	if e.IsStatic() {
+		v, err := e.Eval(tc.ctx, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		return Value{v}, tp, nil
+	}
+
+	return e, tp, nil
+}
+
+func typeOfValue(v interface{}, desired *types.FieldType) *types.FieldType {
+	if v == nil {
+		if desired != nil {
+			return desired
+		}
+		return types.NewFieldType(mysql.TypeNull)
+	}
+
+	switch v.(type) {
+	case int64, uint64, int, bool:
+		return types.NewFieldType(mysql.TypeLonglong)
+	case float64:
+		return types.NewFieldType(mysql.TypeDouble)
+	case mysql.Decimal:
+		return types.NewFieldType(mysql.TypeNewDecimal)
+	case mysql.Time:
+		return types.NewFieldType(mysql.TypeDatetime)
+	case mysql.Duration:
+		return types.NewFieldType(mysql.TypeDuration)
+	case string, []byte:
+		return types.NewFieldType(mysql.TypeVarString)
+	default:
+		if desired != nil {
+			return desired
+		}
+		return types.NewFieldType(mysql.TypeVarString)
+	}
+}
+
+// isComparisonOrLogicalOp reports whether op produces a boolean (0/1)
+// result rather than a value in its operands' own type, e.g. `a = b` or
+// `a AND b`, matching how IsNull/IsTruth/PatternIn/Between/CompareSubQuery
+// are typed in check.
+func isComparisonOrLogicalOp(op opcode.Op) bool {
+	switch op {
+	case opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.EQ, opcode.NE, opcode.NullEQ,
+		opcode.AndAnd, opcode.OrOr, opcode.LogicXor:
+		return true
+	default:
+		return false
+	}
+}
+
+// typeRank orders types by MySQL's implicit promotion rules: the unified
+// type of two operands is whichever ranks higher.
+func typeRank(tp byte) int {
+	switch tp {
+	case mysql.TypeNull:
+		return 0
+	case mysql.TypeLonglong, mysql.TypeLong, mysql.TypeShort, mysql.TypeTiny, mysql.TypeInt24:
+		return 1
+	case mysql.TypeNewDecimal, mysql.TypeDecimal:
+		return 2
+	case mysql.TypeDouble, mysql.TypeFloat:
+		return 3
+	case mysql.TypeDatetime, mysql.TypeTimestamp, mysql.TypeDate, mysql.TypeDuration:
+		return 4
+	default:
+		return 5 // strings and everything else win, matching MySQL's string fallback.
+	}
+}
+
+// unifyType merges two operand types following MySQL's promotion rules:
+// int -> decimal -> double -> string, with NULL always deferring to the
+// other operand (or the caller's desired type, via typeOfValue).
+func unifyType(a, b *types.FieldType) *types.FieldType {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.Tp == mysql.TypeNull:
+		return b
+	case b.Tp == mysql.TypeNull:
+		return a
+	case typeRank(a.Tp) >= typeRank(b.Tp):
+		return a
+	default:
+		return b
+	}
+}
+
+// SanitizeVarFreeExpr type checks expr against expected and rejects any
+// construct whose value depends on session or query state: identifiers
+// other than CURRENT_TIMESTAMP, user variables, sub-queries, DEFAULT(),
+// ordinal positions, and ? markers.
+// It is meant to be called from DDL when validating a column's DEFAULT
+// clause or a CHECK constraint, and from getTimeValue when parsing a
+// datetime/timestamp column's default value, where an expression must be
+// safe to evaluate once, outside of any row context. context names the
+// clause being validated, for use in the returned error.
+func SanitizeVarFreeExpr(expr Expression, expected *types.FieldType, context string) error {
+	if err := checkVarFree(expr); err != nil {
+		return errors.Errorf("%s: %v", context, err)
+	}
+
+	typed, err := TypeCheck(nil, expr, expected)
+	if err != nil {
+		return errors.Errorf("%s: %v", context, err)
+	}
+
+	if expected != nil && typed.ResolvedType() != nil && typed.ResolvedType().Tp != expected.Tp {
+		return errors.Errorf("%s: expected type %v, got %v", context, expected, typed.ResolvedType())
+	}
+
+	return nil
+}
+
+func checkVarFree(e Expression) error {
+	switch x := e.(type) {
+	case *Ident:
+		if IsCurrentTimeExpr(x) {
+			return nil
+		}
+		return errors.Errorf("column reference %s is not allowed here", x)
+	case *Variable:
+		return errors.Errorf("user variables are not allowed here")
+	case SubQuery:
+		return errors.Errorf("sub-queries are not allowed here")
+	case *Default:
+		return errors.Errorf("DEFAULT() is not allowed here")
+	case *Position:
+		return errors.Errorf("ordinal references are not allowed here")
+	case *ParamMarker:
+		return errors.Errorf("? placeholders are not allowed here")
+	case *BinaryOperation:
+		if err := checkVarFree(x.L); err != nil {
+			return err
+		}
+		return checkVarFree(x.R)
+	case *UnaryOperation:
+		return checkVarFree(x.V)
+	case *PExpr:
+		return checkVarFree(x.Expr)
+	case *IsNull:
+		return checkVarFree(x.Expr)
+	case *IsTruth:
+		return checkVarFree(x.Expr)
+	case *Between:
+		if err := checkVarFree(x.Expr); err != nil {
+			return err
+		}
+		if err := checkVarFree(x.Left); err != nil {
+			return err
+		}
+		return checkVarFree(x.Right)
+	case *Row:
+		for _, v := range x.Values {
+			if err := checkVarFree(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Call:
+		for _, arg := range x.Args {
+			if err := checkVarFree(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *PatternIn:
+		if x.Sel != nil {
+			return errors.Errorf("sub-queries are not allowed here")
+		}
+		if err := checkVarFree(x.Expr); err != nil {
+			return err
+		}
+		for _, v := range x.List {
+			if err := checkVarFree(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *PatternLike:
+		if err := checkVarFree(x.Expr); err != nil {
+			return err
+		}
+		return checkVarFree(x.Pattern)
+	case *CompareSubQuery:
+		return errors.Errorf("sub-queries are not allowed here")
+	case *FunctionCast:
+		if x.Expr != nil {
+			return checkVarFree(x.Expr)
+		}
+		return nil
+	case *FunctionConvert:
+		if x.Expr != nil {
+			return checkVarFree(x.Expr)
+		}
+		return nil
+	case *FunctionSubstring:
+		if x.StrExpr != nil {
+			if err := checkVarFree(x.StrExpr); err != nil {
+				return err
+			}
+		}
+		if x.Pos != nil {
+			if err := checkVarFree(x.Pos); err != nil {
+				return err
+			}
+		}
+		if x.Len != nil {
+			return checkVarFree(x.Len)
+		}
+		return nil
+	case *FunctionCase:
+		if x.Value != nil {
+			if err := checkVarFree(x.Value); err != nil {
+				return err
+			}
+		}
+		for _, w := range x.WhenClauses {
+			if err := checkVarFree(w); err != nil {
+				return err
+			}
+		}
+		if x.ElseClause != nil {
+			return checkVarFree(x.ElseClause)
+		}
+		return nil
+	case *WhenClause:
+		if err := checkVarFree(x.Expr); err != nil {
+			return err
+		}
+		return checkVarFree(x.Result)
+	case *ExistsSubQuery:
+		return errors.Errorf("sub-queries are not allowed here")
+	default:
+		return nil
+	}
+}
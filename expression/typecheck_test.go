@@ -0,0 +1,109 @@
+// Copyright 2014 The TiDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expression
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/model"
+	mysql "github.com/pingcap/tidb/mysqldef"
+	"github.com/pingcap/tidb/parser/opcode"
+	"github.com/pingcap/tidb/util/types"
+)
+
+var _ = Suite(&testTypeCheckSuite{})
+
+type testTypeCheckSuite struct{}
+
+func (s *testTypeCheckSuite) TestUnifyTypePromotion(c *C) {
+	intType := types.NewFieldType(mysql.TypeLonglong)
+	decType := types.NewFieldType(mysql.TypeNewDecimal)
+	doubleType := types.NewFieldType(mysql.TypeDouble)
+	strType := types.NewFieldType(mysql.TypeVarString)
+
+	c.Assert(unifyType(intType, decType).Tp, Equals, mysql.TypeNewDecimal)
+	c.Assert(unifyType(decType, doubleType).Tp, Equals, mysql.TypeDouble)
+	c.Assert(unifyType(doubleType, strType).Tp, Equals, mysql.TypeVarString)
+	c.Assert(unifyType(nil, intType).Tp, Equals, mysql.TypeLonglong)
+	c.Assert(unifyType(types.NewFieldType(mysql.TypeNull), intType).Tp, Equals, mysql.TypeLonglong)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckRejectsBadArity(c *C) {
+	call := &Call{F: "now", Args: []Expression{Value{int64(1)}, Value{int64(2)}, Value{int64(3)}}}
+	_, err := TypeCheck(nil, call, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckRejectsUnknownFunction(c *C) {
+	call := &Call{F: "no_such_function", Args: nil}
+	_, err := TypeCheck(nil, call, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckResolvesValueType(c *C) {
+	typed, err := TypeCheck(nil, Value{int64(1)}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(typed.ResolvedType().Tp, Equals, mysql.TypeLonglong)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckComparisonIsBoolean(c *C) {
+	cmp := &BinaryOperation{
+		Op: opcode.EQ,
+		L:  &Ident{model.NewCIStr("c")},
+		R:  Value{"x"},
+	}
+
+	typed, err := TypeCheck(nil, cmp, nil)
+	c.Assert(err, IsNil)
+	c.Assert(typed.ResolvedType().Tp, Equals, mysql.TypeLonglong)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckResolvesAggregateRefAndIndexedVar(c *C) {
+	ref := &AggregateRef{Index: 0}
+	typed, err := TypeCheck(nil, ref, types.NewFieldType(mysql.TypeLonglong))
+	c.Assert(err, IsNil)
+	c.Assert(typed.ResolvedType().Tp, Equals, mysql.TypeLonglong)
+
+	iv := &IndexedVar{Idx: 0, Typ: types.NewFieldType(mysql.TypeVarString)}
+	typed, err = TypeCheck(nil, iv, nil)
+	c.Assert(err, IsNil)
+	c.Assert(typed.ResolvedType().Tp, Equals, mysql.TypeVarString)
+}
+
+func (s *testTypeCheckSuite) TestTypeCheckFoldsStaticSubtree(c *C) {
+	// col > 1+2: the whole expression is not static (col is dynamic), but
+	// the 1+2 subexpression should fold down to Value{3} instead of being
+	// left as an unevaluated BinaryOperation that gets re-added every row.
+	inner := &BinaryOperation{Op: opcode.Plus, L: Value{int64(1)}, R: Value{int64(2)}}
+	col := &IndexedVar{Idx: 0, Typ: types.NewFieldType(mysql.TypeLonglong)}
+	outer := &BinaryOperation{Op: opcode.GT, L: col, R: inner}
+
+	typed, err := TypeCheck(nil, outer, nil)
+	c.Assert(err, IsNil)
+
+	te, ok := typed.(*typedExpression)
+	c.Assert(ok, IsTrue)
+	bin, ok := te.Expression.(*BinaryOperation)
+	c.Assert(ok, IsTrue)
+
+	v, ok := bin.R.(Value)
+	c.Assert(ok, IsTrue)
+	c.Assert(v.Val, Equals, int64(3))
+}
+
+func (s *testTypeCheckSuite) TestSanitizeVarFreeExprRejectsIdent(c *C) {
+	err := SanitizeVarFreeExpr(&Ident{model.NewCIStr("c")}, nil, "default value")
+	c.Assert(err, NotNil)
+}
+
+func (s *testTypeCheckSuite) TestSanitizeVarFreeExprRejectsSubQueryInCall(c *C) {
+	call := &Call{F: "abs", Args: []Expression{&ExistsSubQuery{}}}
+	err := SanitizeVarFreeExpr(call, nil, "check constraint")
+	c.Assert(err, NotNil)
+}
+
+func (s *testTypeCheckSuite) TestSanitizeVarFreeExprAllowsCurrentTimestamp(c *C) {
+	err := SanitizeVarFreeExpr(CurrentTimeExpr, types.NewFieldType(mysql.TypeDatetime), "default value")
+	c.Assert(err, IsNil)
+}